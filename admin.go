@@ -0,0 +1,39 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import "net/http"
+
+// IndexRebuilder is implemented by Store backends that maintain a
+// secondary index derived from their primary data and can rebuild it from
+// scratch, should the two ever drift apart
+type IndexRebuilder interface {
+	RebuildIndex() error
+}
+
+// RebuildIndexHandler rebuilds the store's secondary index. Backends
+// without one (anything but BoltStore, so far) report 501.
+func RebuildIndexHandler(w http.ResponseWriter, r *http.Request) {
+	rebuilder, ok := store.(IndexRebuilder)
+	if !ok {
+		HTTPError(w, http.StatusNotImplemented, "501 - Store backend has no index to rebuild")
+		return
+	}
+	if err := rebuilder.RebuildIndex(); err != nil {
+		HTTPServerError(w)
+		return
+	}
+}
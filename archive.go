@@ -0,0 +1,109 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// openGroupForArchive loads a group by ID and writes the matching HTTP
+// error if it can't be served; ok is false when the handler should stop.
+func openGroupForArchive(w http.ResponseWriter, r *http.Request) (file *WpasteGroup, ok bool) {
+	vars := mux.Vars(r)
+	file, err := OpenWpasteByName(vars["id"])
+	if err != nil {
+		HTTPServerError(w)
+		return nil, false
+	}
+
+	r.ParseForm()
+	if !file.Exist() {
+		HTTPError(w, http.StatusNotFound, "404 - File not found")
+		return nil, false
+	} else if file.Expired() {
+		HTTPError(w, http.StatusGone, "410 - File is no longer available")
+		return nil, false
+	} else if !file.AllowAccess(r.Form.Get("ap")) {
+		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
+		return nil, false
+	}
+	return file, true
+}
+
+// SendTarGz streams every member of a group as a gzip-compressed tarball
+func SendTarGz(w http.ResponseWriter, r *http.Request) {
+	file, ok := openGroupForArchive(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+file.Name+`.tar.gz"`)
+
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	for _, member := range file.Members() {
+		header := &tar.Header{
+			Name: member.Filename,
+			Mode: 0644,
+			Size: int64(len(member.Data)),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			log.Println(err)
+			return
+		}
+		if _, err := tw.Write([]byte(member.Data)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// SendZip streams every member of a group as a zip archive
+func SendZip(w http.ResponseWriter, r *http.Request) {
+	file, ok := openGroupForArchive(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+file.Name+`.zip"`)
+
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	for _, member := range file.Members() {
+		member := member
+		fw, err := zw.Create(member.Filename)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if _, err := fw.Write([]byte(member.Data)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// authRequired gates AuthMiddleware; set from the --auth-required flag
+var authRequired bool
+
+// apiKeys is the store every request authenticates against when
+// authRequired is set
+var apiKeys *APIKeyStore
+
+// APIKey holds the quota and usage state bound to a single issued key. The
+// raw key is never stored, only its SHA-256 hash.
+type APIKey struct {
+	Name          string
+	HashedKey     string
+	MaxPasteSize  int64
+	MaxTotalBytes int64
+	BytesUsed     int64
+	RateLimit     float64
+	Revoked       bool
+	Created       int64
+}
+
+// APIKeyStore keeps APIKey records in a bbolt bucket, keyed by HashedKey
+type APIKeyStore struct {
+	db *bbolt.DB
+
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+// NewAPIKeyStore opens (creating if necessary) a bbolt database at path to
+// keep API keys in
+func NewAPIKeyStore(path string) (*APIKeyStore, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("apikeys"))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &APIKeyStore{db: db, limiters: make(map[string]*rateLimiter)}, nil
+}
+
+// Close closes the underlying bbolt database
+func (s *APIKeyStore) Close() error {
+	return s.db.Close()
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Add generates a new random key with the given quotas, stores it under
+// name and returns the raw key - it is only ever shown this once
+func (s *APIKeyStore) Add(name string, maxPasteSize, maxTotalBytes int64, rateLimit float64) (key string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	key = hex.EncodeToString(raw)
+
+	record := APIKey{
+		Name:          name,
+		HashedKey:     hashAPIKey(key),
+		MaxPasteSize:  maxPasteSize,
+		MaxTotalBytes: maxTotalBytes,
+		RateLimit:     rateLimit,
+		Created:       time.Now().UTC().UnixNano(),
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		data, err := encodeAPIKey(record)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("apikeys")).Put([]byte(record.HashedKey), data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Revoke marks the key as revoked, so Lookup stops accepting it
+func (s *APIKeyStore) Revoke(key string) error {
+	hashed := hashAPIKey(key)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("apikeys"))
+		data := bucket.Get([]byte(hashed))
+		if len(data) == 0 {
+			return errors.New("unknown API key")
+		}
+		record, err := decodeAPIKey(data)
+		if err != nil {
+			return err
+		}
+		record.Revoked = true
+		encoded, err := encodeAPIKey(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hashed), encoded)
+	})
+}
+
+// List returns every issued key's record
+func (s *APIKeyStore) List() (keys []APIKey, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("apikeys")).ForEach(func(k, v []byte) error {
+			record, err := decodeAPIKey(v)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, record)
+			return nil
+		})
+	})
+	return
+}
+
+// Lookup returns the record for key, or nil if it doesn't exist
+func (s *APIKeyStore) Lookup(key string) (record *APIKey, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte("apikeys")).Get([]byte(hashAPIKey(key)))
+		if len(data) == 0 {
+			return nil
+		}
+		r, err := decodeAPIKey(data)
+		if err != nil {
+			return err
+		}
+		record = &r
+		return nil
+	})
+	return
+}
+
+// AddUsage adjusts the key's recorded usage by n bytes, which may be
+// negative to refund bytes freed by an edit or delete; BytesUsed is meant
+// to track currently-stored bytes, not cumulative bytes ever written
+func (s *APIKeyStore) AddUsage(hashedKey string, n int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("apikeys"))
+		data := bucket.Get([]byte(hashedKey))
+		if len(data) == 0 {
+			return nil
+		}
+		record, err := decodeAPIKey(data)
+		if err != nil {
+			return err
+		}
+		record.BytesUsed += n
+		encoded, err := encodeAPIKey(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hashedKey), encoded)
+	})
+}
+
+// Allow reports whether a request against hashedKey is within its
+// requests-per-second budget, consuming one token from its bucket
+func (s *APIKeyStore) Allow(hashedKey string, ratePerSecond float64) bool {
+	if ratePerSecond <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	limiter, ok := s.limiters[hashedKey]
+	if !ok {
+		limiter = newRateLimiter(ratePerSecond)
+		s.limiters[hashedKey] = limiter
+	}
+	s.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+func encodeAPIKey(record APIKey) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(record)
+	return buf.Bytes(), err
+}
+
+func decodeAPIKey(data []byte) (record APIKey, err error) {
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+	return
+}
+
+// rateLimiter is a simple token bucket, refilled at ratePerSecond and
+// capped at one second's worth of burst
+type rateLimiter struct {
+	mu         sync.Mutex
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, lastRefill: time.Now()}
+}
+
+func (l *rateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.lastRefill).Seconds()
+	l.lastRefill = now
+
+	l.tokens += elapsed * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+type contextKey int
+
+const apiKeyContextKey contextKey = 0
+
+// apiKeyFromContext returns the APIKey AuthMiddleware attached to r, or nil
+// if auth isn't required
+func apiKeyFromContext(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*APIKey)
+	return key
+}
+
+// bearerKey returns the API key carried by an Authorization: Bearer header
+// or an "auth" cookie
+func bearerKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := r.Cookie("auth"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// AuthMiddleware rejects requests that don't carry a valid, non-revoked
+// API key, and otherwise attaches the key's record to the request context
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := bearerKey(r)
+		if len(key) == 0 {
+			HTTPError(w, http.StatusUnauthorized, "401 - API key required")
+			return
+		}
+
+		record, err := apiKeys.Lookup(key)
+		if err != nil {
+			HTTPServerError(w)
+			return
+		}
+		if record == nil || record.Revoked {
+			HTTPError(w, http.StatusUnauthorized, "401 - Invalid API key")
+			return
+		}
+		if !apiKeys.Allow(record.HashedKey, record.RateLimit) {
+			HTTPError(w, http.StatusTooManyRequests, "429 - Rate limit exceeded")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey, record)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
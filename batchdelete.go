@@ -0,0 +1,118 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+var (
+	errNotFound     = errors.New("404 - File not found")
+	errUnauthorized = errors.New("401 - Invalid password")
+)
+
+// BatchDeleteResult reports the outcome of deleting a single id as part of
+// a BatchDeleteFile request
+type BatchDeleteResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchDeleteFile deletes several pastes in one request. The form carries
+// repeated "id" values and, aligned by position, the matching "ep" edit
+// password for each one. Every id is checked against its password first;
+// the ones that pass are then removed in a single call to
+// store.DeleteMany, so a backend like BoltStore can delete them all in one
+// write transaction instead of one per id; any deleted paste's size is
+// refunded to its owning API key's byte quota. The response is a JSON array
+// of BatchDeleteResult reporting the per-id outcome.
+func BatchDeleteFile(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ids := r.Form["id"]
+	passwords := r.Form["ep"]
+
+	results := make([]BatchDeleteResult, len(ids))
+	var toDelete []uint64
+	var toDeleteFiles []*WpasteGroup
+	var toDeleteResult []int
+
+	for i, id := range ids {
+		var password string
+		if i < len(passwords) {
+			password = passwords[i]
+		}
+
+		results[i] = BatchDeleteResult{ID: id}
+		file, err := checkDeletable(id, password)
+		if err != nil {
+			results[i].Status = "error"
+			results[i].Error = err.Error()
+			continue
+		}
+
+		toDelete = append(toDelete, file.id)
+		toDeleteFiles = append(toDeleteFiles, file)
+		toDeleteResult = append(toDeleteResult, i)
+	}
+
+	if len(toDelete) != 0 {
+		for j, err := range store.DeleteMany(toDelete) {
+			i := toDeleteResult[j]
+			if err != nil {
+				results[i].Status = "error"
+				results[i].Error = err.Error()
+				continue
+			}
+			results[i].Status = "deleted"
+			if file := toDeleteFiles[j]; apiKeys != nil && len(file.APIKeyHash) != 0 {
+				apiKeys.AddUsage(file.APIKeyHash, -file.Size())
+			}
+		}
+	}
+
+	failed := false
+	for _, result := range results {
+		if result.Status == "error" {
+			failed = true
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if failed {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// checkDeletable returns the paste named id if password matches its edit
+// password, the same rule DeleteFile applies to a single delete
+func checkDeletable(id, password string) (*WpasteGroup, error) {
+	file, err := OpenWpasteByName(id)
+	if err != nil {
+		return nil, err
+	}
+	if !file.Exist() {
+		return nil, errNotFound
+	}
+	if !file.AllowEdit(password) {
+		return nil, errUnauthorized
+	}
+	return file, nil
+}
@@ -0,0 +1,244 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"strconv"
+
+	"go.etcd.io/bbolt"
+)
+
+// BoltStore is the default Store backed by a single bbolt database file
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore opens (creating if necessary) a bbolt database at name and
+// returns a Store backed by it. If the database already holds pastes from
+// before the "names" index existed, it is populated from them once.
+func NewBoltStore(name string) (*BoltStore, error) {
+	db, err := bbolt.Open(name, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte("files")); err != nil {
+			return err
+		}
+		names, err := tx.CreateBucketIfNotExists([]byte("names"))
+		if err != nil {
+			return err
+		}
+		if names.Stats().KeyN > 0 {
+			return nil
+		}
+		return populateNames(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// populateNames fills the "names" bucket from every group already in the
+// "files" bucket; it assumes "names" is empty or about to be replaced
+func populateNames(tx *bbolt.Tx) error {
+	files := tx.Bucket([]byte("files"))
+	names := tx.Bucket([]byte("names"))
+
+	cur := files.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		if len(v) == 0 {
+			continue
+		}
+		f, err := DeserializeWpasteGroup(v)
+		if err != nil {
+			continue
+		}
+		if err := names.Put([]byte(f.Name), k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying bbolt database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Put implements Store
+func (s *BoltStore) Put(w *WpasteGroup) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		files := tx.Bucket([]byte("files"))
+		names := tx.Bucket([]byte("names"))
+
+		if w.id == 0 {
+			w.id, _ = files.NextSequence()
+		}
+		idBytes := []byte(strconv.FormatUint(w.id, 10))
+
+		data, err := w.Serialize()
+		if err != nil {
+			return err
+		}
+		if err := files.Put(idBytes, data); err != nil {
+			return err
+		}
+		return names.Put([]byte(w.Name), idBytes)
+	})
+}
+
+// Get implements Store
+func (s *BoltStore) Get(id uint64) (file *WpasteGroup, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		files := tx.Bucket([]byte("files"))
+		v := files.Get([]byte(strconv.FormatUint(id, 10)))
+		if len(v) == 0 {
+			return nil
+		}
+		f, err := DeserializeWpasteGroup(v)
+		if err != nil {
+			return err
+		}
+		f.id = id
+		file = f
+		return nil
+	})
+	return
+}
+
+// Delete implements Store
+func (s *BoltStore) Delete(id uint64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		files := tx.Bucket([]byte("files"))
+		names := tx.Bucket([]byte("names"))
+		idBytes := []byte(strconv.FormatUint(id, 10))
+
+		if v := files.Get(idBytes); len(v) > 0 {
+			if f, err := DeserializeWpasteGroup(v); err == nil {
+				if err := names.Delete([]byte(f.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		return files.Delete(idBytes)
+	})
+}
+
+// DeleteMany implements Store, removing every id from "files" and "names"
+// in a single bbolt write transaction
+func (s *BoltStore) DeleteMany(ids []uint64) []error {
+	errs := make([]error, len(ids))
+	txErr := s.db.Update(func(tx *bbolt.Tx) error {
+		files := tx.Bucket([]byte("files"))
+		names := tx.Bucket([]byte("names"))
+
+		for i, id := range ids {
+			idBytes := []byte(strconv.FormatUint(id, 10))
+			if v := files.Get(idBytes); len(v) > 0 {
+				if f, err := DeserializeWpasteGroup(v); err == nil {
+					if err := names.Delete([]byte(f.Name)); err != nil {
+						errs[i] = err
+						continue
+					}
+				}
+			}
+			if err := files.Delete(idBytes); err != nil {
+				errs[i] = err
+			}
+		}
+		return nil
+	})
+	if txErr != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = txErr
+			}
+		}
+	}
+	return errs
+}
+
+// ByName implements Store, looking the name up in the "names" index
+// instead of scanning every group
+func (s *BoltStore) ByName(name string) (file *WpasteGroup, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		names := tx.Bucket([]byte("names"))
+		idBytes := names.Get([]byte(name))
+		if len(idBytes) == 0 {
+			return nil
+		}
+
+		files := tx.Bucket([]byte("files"))
+		v := files.Get(idBytes)
+		if len(v) == 0 {
+			return nil
+		}
+		f, err := DeserializeWpasteGroup(v)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseUint(string(idBytes), 10, 64)
+		if err != nil {
+			return err
+		}
+		f.id = id
+		file = f
+		return nil
+	})
+	return
+}
+
+// RebuildIndex clears and repopulates the "names" index from the "files"
+// bucket; implements IndexRebuilder for the /admin/rebuild-index endpoint
+func (s *BoltStore) RebuildIndex() error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("names")); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte("names")); err != nil {
+			return err
+		}
+		return populateNames(tx)
+	})
+}
+
+// Iterate implements Store
+func (s *BoltStore) Iterate(fn func(*WpasteGroup) bool) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		files := tx.Bucket([]byte("files"))
+		cur := files.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if len(v) == 0 {
+				continue
+			}
+			f, err := DeserializeWpasteGroup(v)
+			if err != nil {
+				continue
+			}
+			id, err := strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				continue
+			}
+			f.id = id
+			if !fn(f) {
+				break
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,45 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// deleteTokenBytes is the amount of randomness in a generated delete token,
+// before hex encoding doubles its length
+const deleteTokenBytes = 16
+
+// GenerateDeleteToken returns a random, hard to guess token suitable for
+// deleting a paste without knowing its edit password
+func GenerateDeleteToken() (string, error) {
+	b := make([]byte, deleteTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AllowDeleteToken return true if token is non-empty and matches the
+// group's delete token, compared in constant time
+func (w *WpasteGroup) AllowDeleteToken(token string) bool {
+	if len(token) == 0 || len(w.DeleteToken) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.DeleteToken)) == 1
+}
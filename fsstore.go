@@ -0,0 +1,274 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fsMeta holds the small, fixed-size fields of a WpasteGroup; it is kept in
+// its own file so ByName can scan for a name match without decoding every
+// paste's, possibly large, body
+type fsMeta struct {
+	Name           string
+	Filename       string
+	Language       string
+	AccessPassword string
+	EditPassword   string
+	DeleteToken    string
+	Created        int64
+	ExpiresAfter   int64
+	Edited         int64
+	APIKeyHash     string
+}
+
+// fsBody holds the file contents of a WpasteGroup
+type fsBody struct {
+	Data  string
+	Files []WpasteMember
+}
+
+// FSStore is a Store that keeps each paste as a pair of files, metadata and
+// body, under a directory on the local filesystem
+type FSStore struct {
+	dir string
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// NewFSStore returns a Store that writes pastes under dir, creating it if
+// necessary
+func NewFSStore(dir string) (*FSStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &FSStore{dir: dir}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		id, ok := idFromFilename(entry.Name())
+		if ok && id > s.seq {
+			s.seq = id
+		}
+	}
+	return s, nil
+}
+
+func idFromFilename(name string) (id uint64, ok bool) {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".meta"), ".body")
+	id, err := strconv.ParseUint(name, 10, 64)
+	return id, err == nil
+}
+
+func (s *FSStore) metaPath(id uint64) string {
+	return filepath.Join(s.dir, strconv.FormatUint(id, 10)+".meta")
+}
+
+func (s *FSStore) bodyPath(id uint64) string {
+	return filepath.Join(s.dir, strconv.FormatUint(id, 10)+".body")
+}
+
+// Put implements Store
+func (s *FSStore) Put(w *WpasteGroup) error {
+	if w.id == 0 {
+		s.mu.Lock()
+		s.seq++
+		w.id = s.seq
+		s.mu.Unlock()
+	}
+
+	meta := fsMeta{
+		Name:           w.Name,
+		Filename:       w.Filename,
+		Language:       w.Language,
+		AccessPassword: w.AccessPassword,
+		EditPassword:   w.EditPassword,
+		DeleteToken:    w.DeleteToken,
+		Created:        w.Created,
+		ExpiresAfter:   w.ExpiresAfter,
+		Edited:         w.Edited,
+		APIKeyHash:     w.APIKeyHash,
+	}
+	body := fsBody{Data: w.Data, Files: w.Files}
+
+	metaBytes, err := encodeGob(meta)
+	if err != nil {
+		return err
+	}
+	bodyBytes, err := encodeGob(body)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(s.metaPath(w.id), metaBytes, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.bodyPath(w.id), bodyBytes, 0600)
+}
+
+// Get implements Store
+func (s *FSStore) Get(id uint64) (*WpasteGroup, error) {
+	metaBytes, err := ioutil.ReadFile(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	bodyBytes, err := ioutil.ReadFile(s.bodyPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta fsMeta
+	if err := decodeGob(metaBytes, &meta); err != nil {
+		return nil, err
+	}
+	var body fsBody
+	if err := decodeGob(bodyBytes, &body); err != nil {
+		return nil, err
+	}
+
+	return &WpasteGroup{
+		id:             id,
+		Name:           meta.Name,
+		Filename:       meta.Filename,
+		Language:       meta.Language,
+		AccessPassword: meta.AccessPassword,
+		EditPassword:   meta.EditPassword,
+		DeleteToken:    meta.DeleteToken,
+		Created:        meta.Created,
+		ExpiresAfter:   meta.ExpiresAfter,
+		Edited:         meta.Edited,
+		APIKeyHash:     meta.APIKeyHash,
+		Data:           body.Data,
+		Files:          body.Files,
+	}, nil
+}
+
+// Delete implements Store
+func (s *FSStore) Delete(id uint64) error {
+	if err := os.Remove(s.metaPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.bodyPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteMany implements Store. The filesystem has no cross-file
+// transaction to offer, so each id is removed with its own Delete call.
+func (s *FSStore) DeleteMany(ids []uint64) []error {
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		errs[i] = s.Delete(id)
+	}
+	return errs
+}
+
+// ByName implements Store. It scans the metadata files for a name match
+// without decoding any paste's body, then hydrates only the match.
+func (s *FSStore) ByName(name string) (file *WpasteGroup, err error) {
+	var id uint64
+	var found bool
+	err = s.iterateMeta(func(entryID uint64, meta fsMeta) bool {
+		if meta.Name == name {
+			id, found = entryID, true
+			return false
+		}
+		return true
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+// iterateMeta calls fn with the metadata of every stored group, without
+// reading the, possibly large, body files
+func (s *FSStore) iterateMeta(fn func(id uint64, meta fsMeta) bool) error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id, ok := idFromFilename(entry.Name())
+		if !ok {
+			continue
+		}
+		metaBytes, err := ioutil.ReadFile(s.metaPath(id))
+		if err != nil {
+			continue
+		}
+		var meta fsMeta
+		if err := decodeGob(metaBytes, &meta); err != nil {
+			continue
+		}
+		if !fn(id, meta) {
+			break
+		}
+	}
+	return nil
+}
+
+// Iterate implements Store
+func (s *FSStore) Iterate(fn func(*WpasteGroup) bool) error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id, ok := idFromFilename(entry.Name())
+		if !ok {
+			continue
+		}
+		f, err := s.Get(id)
+		if err != nil || f == nil {
+			continue
+		}
+		if !fn(f) {
+			break
+		}
+	}
+	return nil
+}
+
+func encodeGob(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func decodeGob(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,83 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// defaultHighlightStyle is used when no/an unknown ?style= is given
+const defaultHighlightStyle = "monokai"
+
+// wantsHighlight reports whether a GET for a paste should render it as
+// syntax-highlighted HTML instead of returning the raw body
+func wantsHighlight(r *http.Request) bool {
+	if len(r.Form.Get("highlight")) != 0 {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// SendHighlighted writes file's body as a full HTML page with the body
+// highlighted by Chroma. lang overrides file.Language when non-empty; style
+// falls back to defaultHighlightStyle when empty or unknown.
+func SendHighlighted(w http.ResponseWriter, file *WpasteGroup, lang, style string) {
+	if len(lang) == 0 {
+		lang = file.Language
+	}
+
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		lexer = lexers.Analyse(file.Data)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	chromaStyle := styles.Get(style)
+	if chromaStyle == nil {
+		chromaStyle = styles.Get(defaultHighlightStyle)
+	}
+
+	iterator, err := lexer.Tokenise(nil, file.Data)
+	if err != nil {
+		HTTPServerError(w)
+		return
+	}
+
+	formatter := html.New(html.Standalone(true))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := formatter.Format(w, chromaStyle, iterator); err != nil {
+		HTTPServerError(w)
+		return
+	}
+}
+
+// ListStyles respond with the name of every Chroma style available for
+// the ?style= query
+func ListStyles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range styles.Names() {
+		w.Write([]byte(name + "\n"))
+	}
+}
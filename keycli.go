@@ -0,0 +1,108 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// defaultAuthDB is the API key database used when -auth-db isn't given
+const defaultAuthDB = "apikeys.db"
+
+// runKeyCommand implements the "wpaste key add|revoke|list" subcommands,
+// letting an operator manage API keys without starting the server
+func runKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wpaste key add|revoke|list [flags]")
+	}
+
+	switch args[0] {
+	case "add":
+		return runKeyAdd(args[1:])
+	case "revoke":
+		return runKeyRevoke(args[1:])
+	case "list":
+		return runKeyList(args[1:])
+	default:
+		return fmt.Errorf("unknown key subcommand %q", args[0])
+	}
+}
+
+func runKeyAdd(args []string) error {
+	fs := flag.NewFlagSet("key add", flag.ExitOnError)
+	authDB := fs.String("auth-db", defaultAuthDB, "bbolt database file API keys are kept in")
+	name := fs.String("name", "", "label to identify this key by")
+	maxPasteSize := fs.Int64("max-paste-size", 0, "max bytes allowed in a single paste; 0 means unlimited")
+	maxTotalBytes := fs.Int64("max-total-bytes", 0, "max bytes this key may ever upload; 0 means unlimited")
+	rateLimit := fs.Float64("rate-limit", 0, "max requests per second; 0 means unlimited")
+	fs.Parse(args)
+
+	keys, err := NewAPIKeyStore(*authDB)
+	if err != nil {
+		return err
+	}
+	defer keys.Close()
+
+	key, err := keys.Add(*name, *maxPasteSize, *maxTotalBytes, *rateLimit)
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func runKeyRevoke(args []string) error {
+	fs := flag.NewFlagSet("key revoke", flag.ExitOnError)
+	authDB := fs.String("auth-db", defaultAuthDB, "bbolt database file API keys are kept in")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: wpaste key revoke [-auth-db file] <key>")
+	}
+
+	keys, err := NewAPIKeyStore(*authDB)
+	if err != nil {
+		return err
+	}
+	defer keys.Close()
+
+	return keys.Revoke(fs.Arg(0))
+}
+
+func runKeyList(args []string) error {
+	fs := flag.NewFlagSet("key list", flag.ExitOnError)
+	authDB := fs.String("auth-db", defaultAuthDB, "bbolt database file API keys are kept in")
+	fs.Parse(args)
+
+	keys, err := NewAPIKeyStore(*authDB)
+	if err != nil {
+		return err
+	}
+	defer keys.Close()
+
+	records, err := keys.List()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		status := "active"
+		if r.Revoked {
+			status = "revoked"
+		}
+		fmt.Printf("%s\t%s\t%s\n", r.Name, r.HashedKey, status)
+	}
+	return nil
+}
@@ -18,18 +18,22 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gomarkdown/markdown"
 	"github.com/gorilla/mux"
-	"go.etcd.io/bbolt"
 )
 
 const charset = "abcdefghijklmnopqrstuvwxyz" +
@@ -45,13 +49,33 @@ func RandomString(length int) string {
 	return string(b)
 }
 
-// WpasteFile is data about file
-type WpasteFile struct {
-	id             uint64
-	Name           string
-	Data           string
+// WpasteMember is a single file stored inside a WpasteGroup. Groups with
+// more than one member are created through a multipart upload and fetched
+// back either one by one or as a tar.gz/zip archive of the whole group.
+type WpasteMember struct {
+	Filename string
+	Data     string
+}
+
+// WpasteGroup is data about a paste. A paste holds one or more files: Data
+// keeps the single-file payload so existing pastes stay readable as-is,
+// while Files holds the extra members of a multi-file upload.
+type WpasteGroup struct {
+	id   uint64
+	Name string
+	Data string
+	// Filename is the original name of the primary file in a multi-file
+	// group; empty for a plain single-value paste
+	Filename string
+	Files    []WpasteMember
+	// Language is the Chroma lexer name used to syntax-highlight the
+	// paste; empty means the lexer should be auto-detected from the body
+	Language       string
 	AccessPassword string
 	EditPassword   string
+	// DeleteToken, when non-empty, is a single-use secret that also
+	// authorizes deleting the paste, as an alternative to EditPassword
+	DeleteToken string
 	// Created is time in UTC and UnixNano when file created
 	Created      int64
 	// ExpiresAfter is time in nanoseconds that must pass after Created
@@ -59,18 +83,58 @@ type WpasteFile struct {
 	ExpiresAfter int64
 	// Edited is time in UTC and UnixNano when file edited
 	Edited       int64
+	// APIKeyHash is the hashed API key that uploaded this paste, if any; it
+	// lets the byte quota be refunded to the right key on delete
+	APIKeyHash string
+}
+
+// Size returns the total number of content bytes the paste occupies,
+// across Data and every member of Files, for API-key byte-quota accounting
+func (w *WpasteGroup) Size() int64 {
+	size := int64(len(w.Data))
+	for _, m := range w.Files {
+		size += int64(len(m.Data))
+	}
+	return size
 }
 
-// Serialize enocde WpasteFile to bytes
-func (w *WpasteFile) Serialize() ([]byte, error) {
+// Members returns every file stored in the group, including the primary
+// payload kept in Data for backward compatibility with single-file pastes.
+func (w *WpasteGroup) Members() []WpasteMember {
+	primary := w.Filename
+	if len(primary) == 0 {
+		primary = "f"
+	}
+	if len(w.Files) == 0 {
+		return []WpasteMember{{Filename: primary, Data: w.Data}}
+	}
+	members := make([]WpasteMember, 0, len(w.Files)+1)
+	members = append(members, WpasteMember{Filename: primary, Data: w.Data})
+	members = append(members, w.Files...)
+	return members
+}
+
+// Member returns the group member with the given filename, or false if
+// there is no such member.
+func (w *WpasteGroup) Member(filename string) (member WpasteMember, ok bool) {
+	for _, m := range w.Members() {
+		if m.Filename == filename {
+			return m, true
+		}
+	}
+	return
+}
+
+// Serialize enocde WpasteGroup to bytes
+func (w *WpasteGroup) Serialize() ([]byte, error) {
 	var result bytes.Buffer
 	err := gob.NewEncoder(&result).Encode(w)
 	return result.Bytes(), err
 }
 
-// DeserializeWpasteFile decode bytes to WpasteFile
-func DeserializeWpasteFile(d []byte) (*WpasteFile, error) {
-	var wpaste WpasteFile
+// DeserializeWpasteGroup decode bytes to WpasteGroup
+func DeserializeWpasteGroup(d []byte) (*WpasteGroup, error) {
+	var wpaste WpasteGroup
 
 	err := gob.NewDecoder(bytes.NewReader(d)).Decode(&wpaste)
 
@@ -78,7 +142,7 @@ func DeserializeWpasteFile(d []byte) (*WpasteFile, error) {
 }
 
 // Expired return true if file expired
-func (w *WpasteFile) Expired() bool {
+func (w *WpasteGroup) Expired() bool {
 	if w.ExpiresAfter != 0 {
 		return time.Now().UTC().UnixNano() > w.Created+w.ExpiresAfter
 	}
@@ -86,13 +150,13 @@ func (w *WpasteFile) Expired() bool {
 }
 
 // Exist return true if file found and exist
-func (w *WpasteFile) Exist() bool {
+func (w *WpasteGroup) Exist() bool {
 	return w != nil
 }
 
 // AllowAccess return true if access password is empty or
 // entered password matches access password
-func (w *WpasteFile) AllowAccess(password string) bool {
+func (w *WpasteGroup) AllowAccess(password string) bool {
 	if len(w.AccessPassword) == 0 || password == w.AccessPassword {
 		return true
 	}
@@ -101,98 +165,49 @@ func (w *WpasteFile) AllowAccess(password string) bool {
 
 // AllowEdit return true if entered password matches access password
 // if edit password is empty always return false
-func (w *WpasteFile) AllowEdit(password string) bool {
+func (w *WpasteGroup) AllowEdit(password string) bool {
 	if len(w.EditPassword) == 0 || password != w.EditPassword {
 		return false
 	}
 	return true
 }
 
-// Save file to db
-func (w *WpasteFile) Save() (err error) {
-	tx, err := db.Begin(true)
-	if err != nil {
-		return
-	}
-	defer tx.Rollback()
-
-	files := tx.Bucket([]byte("files"))
-
-	f, err := w.Serialize()
-	if err != nil {
-		return
-	}
-
-	if w.id == 0 {
-		w.id, _ = files.NextSequence()
-	}
-
-	files.Put([]byte(strconv.FormatUint(w.id, 10)), f)
-	return tx.Commit()
+// Save file to the store
+func (w *WpasteGroup) Save() error {
+	return store.Put(w)
 }
 
-// Delete file from database
-func (w *WpasteFile) Delete() error {
-	return db.Update(func(tx *bbolt.Tx) error {
-		files := tx.Bucket([]byte("files"))
-
-		return files.Delete([]byte(strconv.FormatUint(w.id, 10)))
-	})
+// Delete file from the store
+func (w *WpasteGroup) Delete() error {
+	return store.Delete(w.id)
 }
 
 // OpenWpasteByName return Wpaste if exist else nil
-func OpenWpasteByName(name string) (file *WpasteFile, err error) {
-	tx, err := db.Begin(false)
-	if err != nil {
-		return
-	}
-	defer tx.Rollback()
-	files := tx.Bucket([]byte("files"))
-	for id := files.Sequence(); id > 0; id-- {
-		v := files.Get([]byte(strconv.FormatUint(id, 10)))
-		if len(v) == 0 {
-			continue
-		}
-		var f *WpasteFile
-		f, err = DeserializeWpasteFile(v)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		if f.Name == name {
-			file = f
-			file.id = id
-			return
-		}
-	}
-	return
+func OpenWpasteByName(name string) (*WpasteGroup, error) {
+	return store.ByName(name)
 }
 
 // CheckUnique return true to *unique if value unique
 func CheckUnique(field string, value interface{}) (unique bool) {
-	tx, err := db.Begin(false)
-	if err != nil {
-		return
+	// Name is looked up through the store's indexed ByName instead of a
+	// full scan, since it's the only field callers ever check
+	if field == "Name" {
+		if name, ok := value.(string); ok {
+			f, err := store.ByName(name)
+			return err == nil && f == nil
+		}
 	}
-	defer tx.Rollback()
 
 	unique = true
 
-	files := tx.Bucket([]byte("files"))
-	cur := files.Cursor()
-
-	for k, v := cur.First(); k != nil; k, v = cur.Next() {
-		var f *WpasteFile
-		f, err = DeserializeWpasteFile(v)
-		if err != nil {
-			continue
-		}
-		field := reflect.ValueOf(*f).FieldByName(field)
-		if field.String() == value {
+	store.Iterate(func(f *WpasteGroup) bool {
+		fieldValue := reflect.ValueOf(*f).FieldByName(field)
+		if fieldValue.String() == value {
 			unique = false
-			break
+			return false
 		}
-	}
+		return true
+	})
 
 	return
 }
@@ -219,19 +234,39 @@ func Help(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(markdown.ToHTML(file, nil, nil)))
 }
 
-// UploadFile save file and response it ID
+// UploadFile save file (or, for a multipart request carrying several
+// "files" parts, a group of files under a single paste ID) and response
+// it ID
 func UploadFile(w http.ResponseWriter, r *http.Request) {
 	if r.ContentLength > 2<<20 {
 		HTTPError(w, http.StatusRequestEntityTooLarge, "413 - Max content size is 2MiB")
 		return
-	} else if len(r.FormValue("f")) == 0 {
-		HTTPError(w, http.StatusBadRequest, `400 - "f" field required`)
-		return
 	}
 
-	wpaste := &WpasteFile{Created: time.Now().UTC().UnixNano()}
+	r.ParseMultipartForm(2 << 20)
 
-	wpaste.Data = r.FormValue("f")
+	wpaste := &WpasteGroup{Created: time.Now().UTC().UnixNano()}
+
+	if r.MultipartForm != nil && len(r.MultipartForm.File["files"]) != 0 {
+		headers := r.MultipartForm.File["files"]
+		members := make([]WpasteMember, 0, len(headers))
+		for _, header := range headers {
+			data, err := readMultipartFile(header)
+			if err != nil {
+				HTTPServerError(w)
+				return
+			}
+			members = append(members, WpasteMember{Filename: header.Filename, Data: data})
+		}
+		wpaste.Data = members[0].Data
+		wpaste.Filename = members[0].Filename
+		wpaste.Files = members[1:]
+	} else if len(r.FormValue("f")) != 0 {
+		wpaste.Data = r.FormValue("f")
+	} else {
+		HTTPError(w, http.StatusBadRequest, `400 - "f" field required`)
+		return
+	}
 
 	name := r.FormValue("name")
 
@@ -263,13 +298,75 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 
 	wpaste.AccessPassword = r.FormValue("ap")
 	wpaste.EditPassword = r.FormValue("ep")
+	wpaste.Language = r.FormValue("lang")
+
+	size := wpaste.Size()
+	if apiKey := apiKeyFromContext(r); apiKey != nil {
+		if apiKey.MaxPasteSize > 0 && size > apiKey.MaxPasteSize {
+			HTTPError(w, http.StatusRequestEntityTooLarge, "413 - Paste exceeds this API key's max paste size")
+			return
+		}
+		if apiKey.MaxTotalBytes > 0 && apiKey.BytesUsed+size > apiKey.MaxTotalBytes {
+			HTTPError(w, http.StatusForbidden, "403 - This API key's byte quota is used up")
+			return
+		}
+		wpaste.APIKeyHash = apiKey.HashedKey
+	}
+
+	var deleteToken string
+	if r.FormValue("deleteToken") == "1" {
+		token, err := GenerateDeleteToken()
+		if err != nil {
+			HTTPServerError(w)
+			return
+		}
+		wpaste.DeleteToken = token
+		deleteToken = token
+	}
 
 	if err := wpaste.Save(); err != nil {
 		HTTPServerError(w)
 		return
 	}
 
-	w.Write([]byte(name))
+	if apiKey := apiKeyFromContext(r); apiKey != nil {
+		apiKeys.AddUsage(apiKey.HashedKey, size)
+	}
+
+	writeUploadResponse(w, r, name, deleteToken)
+}
+
+// writeUploadResponse writes the name of the newly created paste, and its
+// delete token if one was generated, in whichever form the client asked
+// for via Accept
+func writeUploadResponse(w http.ResponseWriter, r *http.Request, name, deleteToken string) {
+	if len(deleteToken) == 0 {
+		w.Write([]byte(name))
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(struct {
+			Name        string `json:"name"`
+			DeleteToken string `json:"deleteToken"`
+		}{name, deleteToken})
+		return
+	}
+
+	w.Write([]byte(name + "\n" + deleteToken))
+}
+
+// readMultipartFile reads a single part of a multipart upload into a string
+func readMultipartFile(header *multipart.FileHeader) (string, error) {
+	f, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	return string(data), err
 }
 
 // SendFile respond file by it ID
@@ -292,9 +389,42 @@ func SendFile(w http.ResponseWriter, r *http.Request) {
 		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
 		return
 	}
+
+	if wantsHighlight(r) {
+		SendHighlighted(w, file, r.Form.Get("highlight"), r.Form.Get("style"))
+		return
+	}
 	w.Write([]byte((*file).Data))
 }
 
+// SendMember respond with a single member of a group by its filename
+func SendMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	file, err := OpenWpasteByName(vars["id"])
+	if err != nil {
+		HTTPServerError(w)
+		return
+	}
+	r.ParseForm()
+	if !file.Exist() {
+		HTTPError(w, http.StatusNotFound, "404 - File not found")
+		return
+	} else if file.Expired() {
+		HTTPError(w, http.StatusGone, "410 - File is no longer available")
+		return
+	} else if !file.AllowAccess(r.Form.Get("ap")) {
+		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
+		return
+	}
+
+	member, ok := file.Member(vars["filename"])
+	if !ok {
+		HTTPError(w, http.StatusNotFound, "404 - File not found")
+		return
+	}
+	w.Write([]byte(member.Data))
+}
+
 // EditFile put new file
 func EditFile(w http.ResponseWriter, r *http.Request) {
 	if r.ContentLength > 10<<20 {
@@ -323,13 +453,30 @@ func EditFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file.Data = r.FormValue("f")
+	newData := r.FormValue("f")
+	delta := int64(len(newData)) - int64(len(file.Data))
+	if apiKey := apiKeyFromContext(r); apiKey != nil {
+		if apiKey.MaxPasteSize > 0 && int64(len(newData)) > apiKey.MaxPasteSize {
+			HTTPError(w, http.StatusRequestEntityTooLarge, "413 - Paste exceeds this API key's max paste size")
+			return
+		}
+		if apiKey.MaxTotalBytes > 0 && apiKey.BytesUsed+delta > apiKey.MaxTotalBytes {
+			HTTPError(w, http.StatusForbidden, "403 - This API key's byte quota is used up")
+			return
+		}
+	}
+
+	file.Data = newData
 	file.Edited = time.Now().UTC().UnixNano()
 
 	if err := file.Save(); err != nil {
 		HTTPServerError(w)
 		return
 	}
+
+	if apiKey := apiKeyFromContext(r); apiKey != nil && delta != 0 {
+		apiKeys.AddUsage(apiKey.HashedKey, delta)
+	}
 }
 
 // DeleteFile set deleted flag to true
@@ -347,7 +494,7 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 	if !file.Exist() {
 		HTTPError(w, http.StatusNotFound, "404 - File not found")
 		return
-	} else if !file.AllowEdit(r.FormValue("ep")) {
+	} else if !file.AllowEdit(r.FormValue("ep")) && !file.AllowDeleteToken(r.FormValue("deleteToken")) {
 		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
 		return
 	}
@@ -356,6 +503,9 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 		HTTPServerError(w)
 		return
 	}
+	if apiKeys != nil && len(file.APIKeyHash) != 0 {
+		apiKeys.AddUsage(file.APIKeyHash, -file.Size())
+	}
 }
 
 // WpasteRouter make router with all needed Handlers
@@ -363,69 +513,57 @@ func WpasteRouter() *mux.Router {
 	Router := mux.NewRouter().StrictSlash(true)
 
 	Router.HandleFunc("/", Help).Methods("GET")
-	Router.HandleFunc("/", UploadFile).Methods("POST")
+	Router.Handle("/", withAuth(UploadFile)).Methods("POST")
+	Router.HandleFunc("/styles", ListStyles).Methods("GET")
+	Router.Handle("/batch-delete", withAuth(BatchDeleteFile)).Methods("POST")
+	Router.Handle("/admin/rebuild-index", withAuth(RebuildIndexHandler)).Methods("POST")
+
+	// archive routes are registered before "/{id}" so that an extension
+	// like ".tar.gz" isn't swallowed by the plain {id} variable
+	Router.HandleFunc("/{id:[^/]+}.tar.gz", SendTarGz).Methods("GET")
+	Router.HandleFunc("/{id:[^/]+}.zip", SendZip).Methods("GET")
+	Router.HandleFunc("/{id}/{filename}", SendMember).Methods("GET")
 
 	Router.HandleFunc("/{id}", SendFile).Methods("GET")
-	Router.HandleFunc("/{id}", EditFile).Methods("PUT")
+	Router.Handle("/{id}", withAuth(EditFile)).Methods("PUT")
 	Router.HandleFunc("/{id}", DeleteFile).Methods("DELETE")
+
 	return Router
 }
 
-// AutoDeleter delete file from db if it expired "add" time ago
+// withAuth wraps handler with AuthMiddleware when authRequired is set,
+// leaving plain viewing (SendFile, SendMember, the archive routes) open so
+// link sharing keeps working without a key
+func withAuth(handler http.HandlerFunc) http.Handler {
+	if !authRequired {
+		return handler
+	}
+	return AuthMiddleware(handler)
+}
+
+// AutoDeleter delete file from the store if it expired "add" time ago
 // and check using timer
 func AutoDeleter(timer *time.Ticker, add int64) {
 	for range timer.C {
-		var toDelete [][]byte
-		db.View(func(tx *bbolt.Tx) error {
-			files := tx.Bucket([]byte("files"))
-
-			files.ForEach(func(k, v []byte) error {
-				if len(v) == 0 {
-					return nil
-				}
-				var f *WpasteFile
-				f, err := DeserializeWpasteFile(v)
-				if err != nil {
-					return err
-				}
-				if f.ExpiresAfter != 0 && time.Now().UTC().UnixNano() > f.Created+f.ExpiresAfter+add {
-					toDelete = append(toDelete, k)
-				}
-				return nil
-			})
-			return nil
+		var toDelete []*WpasteGroup
+		store.Iterate(func(f *WpasteGroup) bool {
+			if f.ExpiresAfter != 0 && time.Now().UTC().UnixNano() > f.Created+f.ExpiresAfter+add {
+				toDelete = append(toDelete, f)
+			}
+			return true
 		})
 
-		if len(toDelete) != 0 {
-			db.Update(func(tx *bbolt.Tx) error {
-				files := tx.Bucket([]byte("files"))
-
-				for _, id := range toDelete {
-					files.Delete(id)
-				}
-				return nil
-			})
+		for _, f := range toDelete {
+			if err := store.Delete(f.id); err != nil {
+				continue
+			}
+			if apiKeys != nil && len(f.APIKeyHash) != 0 {
+				apiKeys.AddUsage(f.APIKeyHash, -f.Size())
+			}
 		}
 	}
 }
 
-var db *bbolt.DB
-
-func initDB(name string) {
-	var err error
-	db, err = bbolt.Open(name, 0600, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("files"))
-		return err
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func logging(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -442,25 +580,100 @@ func logging(handler http.Handler) http.Handler {
 	})
 }
 
-func run(dbname string, tick time.Duration, add int64, start bool) {
-	rand.Seed(time.Now().UTC().UnixNano())
+// Install open a temporary bbolt-backed store for use in tests
+func Install() {
+	s, err := NewBoltStore("test.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = s
+}
+
+// Close close the store opened by Install and remove it from disk
+func Close() {
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
+	os.Remove("test.db")
+}
 
-	initDB(dbname)
+// initStore opens the Store selected by backend, which is one of "bolt",
+// "fs" or "s3"
+func initStore(backend, boltFile, fsDir string, s3cfg S3Config) {
+	var s Store
+	var err error
+
+	switch backend {
+	case "fs":
+		s, err = NewFSStore(fsDir)
+	case "s3":
+		s, err = NewS3Store(s3cfg)
+	default:
+		s, err = NewBoltStore(boltFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = s
+}
+
+func run(tick time.Duration, add int64, start bool) {
+	rand.Seed(time.Now().UTC().UnixNano())
 
 	go AutoDeleter(time.NewTicker(tick), add)
 
 	if start {
-		defer db.Close()
 		http.ListenAndServe(":9990", logging(WpasteRouter()))
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "key" {
+		if err := runKeyCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	f, err := os.OpenFile("log.wpaste", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
 	}
 	defer f.Close()
 	log.SetOutput(f)
-	run("data.db", time.Hour, 4*int64(time.Hour), true)
+
+	backend := flag.String("storage", "bolt", `storage backend to use: "bolt", "fs" or "s3"`)
+	boltFile := flag.String("db", "data.db", `bbolt database file, used when storage is "bolt"`)
+	fsDir := flag.String("data-dir", "data", `directory to keep pastes in, used when storage is "fs"`)
+	s3Endpoint := flag.String("s3-endpoint", "", `S3-compatible endpoint, used when storage is "s3"`)
+	s3Bucket := flag.String("s3-bucket", "wpaste", `S3 bucket name, used when storage is "s3"`)
+	s3AccessKey := flag.String("s3-access-key", "", `S3 access key, used when storage is "s3"`)
+	s3SecretKey := flag.String("s3-secret-key", "", `S3 secret key, used when storage is "s3"`)
+	s3SSL := flag.Bool("s3-ssl", true, `use TLS when talking to the S3 endpoint, used when storage is "s3"`)
+	authRequiredFlag := flag.Bool("auth-required", false, `require a valid API key (see the "key" subcommand) on every request`)
+	authDB := flag.String("auth-db", defaultAuthDB, `bbolt database file API keys are kept in, used when auth-required is set`)
+	flag.Parse()
+
+	initStore(*backend, *boltFile, *fsDir, S3Config{
+		Endpoint:  *s3Endpoint,
+		Bucket:    *s3Bucket,
+		AccessKey: *s3AccessKey,
+		SecretKey: *s3SecretKey,
+		UseSSL:    *s3SSL,
+	})
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	authRequired = *authRequiredFlag
+	if authRequired {
+		keys, err := NewAPIKeyStore(*authDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiKeys = keys
+		defer keys.Close()
+	}
+
+	run(time.Hour, 4*int64(time.Hour), true)
 }
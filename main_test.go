@@ -1,7 +1,15 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
 	"testing"
@@ -11,6 +19,24 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// multipartUpload builds a multipart POST request carrying the given
+// files under the "files" field, the way a multi-file upload client would
+func multipartUpload(t *testing.T, files map[string]string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := writer.CreateFormFile("files", name)
+		assert.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+
+	req := httptest.NewRequest("POST", "/", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
 func TestUploadAndGet(t *testing.T) {
 	Install()
 	defer Close()
@@ -257,4 +283,340 @@ func TestEditFileWithoutEP(t *testing.T) {
 		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
 			assert.Equal(t, http.StatusUnauthorized, r.Code)
 		})
+}
+
+func TestUploadGroupAndGetMembers(t *testing.T) {
+	Install()
+	defer Close()
+
+	files := map[string]string{
+		"a.txt": "first file",
+		"b.txt": "second file",
+	}
+
+	w := httptest.NewRecorder()
+	WpasteRouter().ServeHTTP(w, multipartUpload(t, files))
+	assert.Equal(t, http.StatusOK, w.Code)
+	name := w.Body.String()
+
+	for filename, content := range files {
+		w := httptest.NewRecorder()
+		WpasteRouter().ServeHTTP(w, httptest.NewRequest("GET", "/"+name+"/"+filename, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, content, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	WpasteRouter().ServeHTTP(w, httptest.NewRequest("GET", "/"+name+"/missing.txt", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUploadGroupAndGetTarGz(t *testing.T) {
+	Install()
+	defer Close()
+
+	files := map[string]string{
+		"a.txt": "first file",
+		"b.txt": "second file",
+	}
+
+	w := httptest.NewRecorder()
+	WpasteRouter().ServeHTTP(w, multipartUpload(t, files))
+	assert.Equal(t, http.StatusOK, w.Code)
+	name := w.Body.String()
+
+	w = httptest.NewRecorder()
+	WpasteRouter().ServeHTTP(w, httptest.NewRequest("GET", "/"+name+".tar.gz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	found := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		found[header.Name] = string(data)
+	}
+	assert.Equal(t, files, found)
+}
+
+func TestHighlightedGet(t *testing.T) {
+	Install()
+	defer Close()
+	r := gofight.New()
+
+	var name string
+	r.POST("/").
+		SetForm(gofight.H{
+			"f":    "package main",
+			"lang": "go",
+		}).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+
+	r.GET("/"+name).
+		SetQuery(gofight.H{
+			"highlight": "1",
+		}).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "text/html; charset=utf-8", r.HeaderMap.Get("Content-Type"))
+			assert.Contains(t, r.Body.String(), "<html")
+		})
+}
+
+func TestAuthMiddlewareRequiresAPIKey(t *testing.T) {
+	Install()
+	defer Close()
+
+	dir := t.TempDir()
+	keys, err := NewAPIKeyStore(dir + "/apikeys.db")
+	assert.NoError(t, err)
+	defer keys.Close()
+
+	key, err := keys.Add("ci", 0, 0, 0)
+	assert.NoError(t, err)
+
+	authRequired = true
+	apiKeys = keys
+	defer func() { authRequired = false }()
+
+	router := WpasteRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("f=42")))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader("f=42"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	name := w.Body.String()
+
+	// plain viewing stays anonymous even when auth-required is on, so
+	// link sharing keeps working without a key
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/"+name, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "42", w.Body.String())
+}
+
+// uploadWithKey POSTs f as the body of a new paste authenticated with key,
+// with an edit password so the caller can delete it again, returning the
+// response so callers can assert on its status
+func uploadWithKey(router http.Handler, key, f string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader("f="+f+"&ep=epw"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+key)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeyMaxPasteSizeRejected(t *testing.T) {
+	Install()
+	defer Close()
+
+	dir := t.TempDir()
+	keys, err := NewAPIKeyStore(dir + "/apikeys.db")
+	assert.NoError(t, err)
+	defer keys.Close()
+
+	key, err := keys.Add("ci", 4, 0, 0)
+	assert.NoError(t, err)
+
+	authRequired = true
+	apiKeys = keys
+	defer func() { authRequired = false }()
+
+	router := WpasteRouter()
+
+	w := uploadWithKey(router, key, "42")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = uploadWithKey(router, key, "too big")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestAPIKeyMaxTotalBytesRejected(t *testing.T) {
+	Install()
+	defer Close()
+
+	dir := t.TempDir()
+	keys, err := NewAPIKeyStore(dir + "/apikeys.db")
+	assert.NoError(t, err)
+	defer keys.Close()
+
+	key, err := keys.Add("ci", 0, 10, 0)
+	assert.NoError(t, err)
+
+	authRequired = true
+	apiKeys = keys
+	defer func() { authRequired = false }()
+
+	router := WpasteRouter()
+
+	w := uploadWithKey(router, key, "12345")
+	assert.Equal(t, http.StatusOK, w.Code)
+	name1 := w.Body.String()
+
+	w = uploadWithKey(router, key, "67890")
+	assert.Equal(t, http.StatusOK, w.Code)
+	name2 := w.Body.String()
+
+	// the quota is now fully used, so a third upload is rejected
+	w = uploadWithKey(router, key, "1")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// deleting both pastes frees their bytes back to the quota, so
+	// BytesUsed tracks currently-stored bytes, not cumulative writes
+	del := httptest.NewRecorder()
+	router.ServeHTTP(del, httptest.NewRequest("DELETE", "/"+name1+"?ep=epw", nil))
+	assert.Equal(t, http.StatusOK, del.Code)
+	del = httptest.NewRecorder()
+	router.ServeHTTP(del, httptest.NewRequest("DELETE", "/"+name2+"?ep=epw", nil))
+	assert.Equal(t, http.StatusOK, del.Code)
+
+	record, err := keys.Lookup(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), record.BytesUsed)
+
+	w = uploadWithKey(router, key, "12345")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAPIKeyRateLimitRejected(t *testing.T) {
+	Install()
+	defer Close()
+
+	dir := t.TempDir()
+	keys, err := NewAPIKeyStore(dir + "/apikeys.db")
+	assert.NoError(t, err)
+	defer keys.Close()
+
+	key, err := keys.Add("ci", 0, 0, 1)
+	assert.NoError(t, err)
+
+	authRequired = true
+	apiKeys = keys
+	defer func() { authRequired = false }()
+
+	router := WpasteRouter()
+
+	w := uploadWithKey(router, key, "42")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = uploadWithKey(router, key, "43")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestDeleteTokenDelete(t *testing.T) {
+	Install()
+	defer Close()
+	r := gofight.New()
+
+	var name, token string
+	r.POST("/").
+		SetForm(gofight.H{
+			"f":           "42",
+			"deleteToken": "1",
+		}).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			parts := strings.SplitN(r.Body.String(), "\n", 2)
+			assert.Len(t, parts, 2)
+			name, token = parts[0], parts[1]
+			assert.NotEmpty(t, token)
+		})
+
+	r.DELETE("/"+name).
+		SetQuery(gofight.H{
+			"deleteToken": "wrong token",
+		}).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+
+	r.DELETE("/"+name).
+		SetQuery(gofight.H{
+			"deleteToken": token,
+		}).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+
+	r.GET("/"+name).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+}
+
+func TestBatchDeleteFile(t *testing.T) {
+	Install()
+	defer Close()
+	r := gofight.New()
+
+	password := "USA. Top secret"
+	var deletable, wrongPassword string
+	r.POST("/").
+		SetForm(gofight.H{
+			"f":  "42",
+			"ep": password,
+		}).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			deletable = r.Body.String()
+		})
+	r.POST("/").
+		SetForm(gofight.H{
+			"f":  "43",
+			"ep": password,
+		}).
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			wrongPassword = r.Body.String()
+		})
+
+	w := httptest.NewRecorder()
+	form := make(url.Values)
+	form.Add("id", deletable)
+	form.Add("ep", password)
+	form.Add("id", wrongPassword)
+	form.Add("ep", "China. Top public")
+	req := httptest.NewRequest("POST", "/batch-delete", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	WpasteRouter().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var results []BatchDeleteResult
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Len(t, results, 2)
+	assert.Equal(t, deletable, results[0].ID)
+	assert.Equal(t, "deleted", results[0].Status)
+	assert.Equal(t, wrongPassword, results[1].ID)
+	assert.Equal(t, "error", results[1].Status)
+}
+
+func TestListStyles(t *testing.T) {
+	Install()
+	defer Close()
+	r := gofight.New()
+
+	r.GET("/styles").
+		Run(WpasteRouter(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), "monokai")
+		})
 }
\ No newline at end of file
@@ -0,0 +1,283 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the connection details for an S3-compatible backend
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// S3Store is a Store that keeps each paste, as a metadata object plus a
+// body object, in an S3-compatible bucket
+type S3Store struct {
+	client *minio.Client
+	bucket string
+
+	// seq is a best-effort, in-process id counter; it is seeded from the
+	// highest id already present in the bucket, so it only guarantees
+	// unique ids as long as a single wpaste process writes to the bucket
+	mu  sync.Mutex
+	seq uint64
+}
+
+// NewS3Store connects to an S3-compatible endpoint and returns a Store
+// backed by the given bucket, creating it if it doesn't exist
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &S3Store{client: client, bucket: cfg.Bucket}
+
+	for obj := range client.ListObjects(ctx, cfg.Bucket, minio.ListObjectsOptions{}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if id, ok := idFromFilename(obj.Key); ok && id > s.seq {
+			s.seq = id
+		}
+	}
+	return s, nil
+}
+
+func (s *S3Store) metaKey(id uint64) string {
+	return strconv.FormatUint(id, 10) + ".meta"
+}
+
+func (s *S3Store) bodyKey(id uint64) string {
+	return strconv.FormatUint(id, 10) + ".body"
+}
+
+func (s *S3Store) putObject(key string, data []byte) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, key,
+		bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	return err
+}
+
+func (s *S3Store) getObject(key string) ([]byte, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	data, err := ioutil.ReadAll(obj)
+	if err != nil {
+		if errResp := minio.ToErrorResponse(err); errResp.Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Put implements Store
+func (s *S3Store) Put(w *WpasteGroup) error {
+	if w.id == 0 {
+		s.mu.Lock()
+		s.seq++
+		w.id = s.seq
+		s.mu.Unlock()
+	}
+
+	meta := fsMeta{
+		Name:           w.Name,
+		Filename:       w.Filename,
+		Language:       w.Language,
+		AccessPassword: w.AccessPassword,
+		EditPassword:   w.EditPassword,
+		DeleteToken:    w.DeleteToken,
+		Created:        w.Created,
+		ExpiresAfter:   w.ExpiresAfter,
+		Edited:         w.Edited,
+		APIKeyHash:     w.APIKeyHash,
+	}
+	body := fsBody{Data: w.Data, Files: w.Files}
+
+	metaBytes, err := encodeGob(meta)
+	if err != nil {
+		return err
+	}
+	bodyBytes, err := encodeGob(body)
+	if err != nil {
+		return err
+	}
+
+	if err := s.putObject(s.metaKey(w.id), metaBytes); err != nil {
+		return err
+	}
+	return s.putObject(s.bodyKey(w.id), bodyBytes)
+}
+
+// Get implements Store
+func (s *S3Store) Get(id uint64) (*WpasteGroup, error) {
+	metaBytes, err := s.getObject(s.metaKey(id))
+	if err != nil || metaBytes == nil {
+		return nil, err
+	}
+	bodyBytes, err := s.getObject(s.bodyKey(id))
+	if err != nil || bodyBytes == nil {
+		return nil, err
+	}
+
+	var meta fsMeta
+	if err := decodeGob(metaBytes, &meta); err != nil {
+		return nil, err
+	}
+	var body fsBody
+	if err := decodeGob(bodyBytes, &body); err != nil {
+		return nil, err
+	}
+
+	return &WpasteGroup{
+		id:             id,
+		Name:           meta.Name,
+		Filename:       meta.Filename,
+		Language:       meta.Language,
+		AccessPassword: meta.AccessPassword,
+		EditPassword:   meta.EditPassword,
+		DeleteToken:    meta.DeleteToken,
+		Created:        meta.Created,
+		ExpiresAfter:   meta.ExpiresAfter,
+		Edited:         meta.Edited,
+		APIKeyHash:     meta.APIKeyHash,
+		Data:           body.Data,
+		Files:          body.Files,
+	}, nil
+}
+
+// Delete implements Store
+func (s *S3Store) Delete(id uint64) error {
+	ctx := context.Background()
+	if err := s.client.RemoveObject(ctx, s.bucket, s.metaKey(id), minio.RemoveObjectOptions{}); err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, s.bodyKey(id), minio.RemoveObjectOptions{})
+}
+
+// DeleteMany implements Store. S3 has no cross-object transaction to
+// offer, so each id is removed with its own Delete call.
+func (s *S3Store) DeleteMany(ids []uint64) []error {
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		errs[i] = s.Delete(id)
+	}
+	return errs
+}
+
+// ByName implements Store. It scans the ".meta" objects for a name match
+// without fetching any paste's body, then hydrates only the match.
+func (s *S3Store) ByName(name string) (file *WpasteGroup, err error) {
+	var id uint64
+	var found bool
+	err = s.iterateMeta(func(objID uint64, meta fsMeta) bool {
+		if meta.Name == name {
+			id, found = objID, true
+			return false
+		}
+		return true
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+// iterateMeta calls fn with the metadata of every stored group, without
+// fetching the, possibly large, body objects
+func (s *S3Store) iterateMeta(fn func(id uint64, meta fsMeta) bool) error {
+	ctx := context.Background()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if !strings.HasSuffix(obj.Key, ".meta") {
+			continue
+		}
+		id, ok := idFromFilename(obj.Key)
+		if !ok {
+			continue
+		}
+		metaBytes, err := s.getObject(s.metaKey(id))
+		if err != nil || metaBytes == nil {
+			continue
+		}
+		var meta fsMeta
+		if err := decodeGob(metaBytes, &meta); err != nil {
+			continue
+		}
+		if !fn(id, meta) {
+			break
+		}
+	}
+	return nil
+}
+
+// Iterate implements Store
+func (s *S3Store) Iterate(fn func(*WpasteGroup) bool) error {
+	ctx := context.Background()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if !strings.HasSuffix(obj.Key, ".meta") {
+			continue
+		}
+		id, ok := idFromFilename(obj.Key)
+		if !ok {
+			continue
+		}
+		f, err := s.Get(id)
+		if err != nil || f == nil {
+			continue
+		}
+		if !fn(f) {
+			break
+		}
+	}
+	return nil
+}
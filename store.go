@@ -0,0 +1,38 @@
+// wpaste - easy code sharing
+// Copyright (C) 2020  Evgeniy Rybin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+// Store persists WpasteGroup records. Implementations must be safe for
+// concurrent use, since handlers reach the store from multiple goroutines.
+type Store interface {
+	// Put saves w, assigning it an id if it doesn't already have one.
+	Put(w *WpasteGroup) error
+	// Get returns the group stored under id, or nil if there is none.
+	Get(id uint64) (*WpasteGroup, error)
+	// Delete removes the group stored under id.
+	Delete(id uint64) error
+	// DeleteMany removes every group in ids, as a single write where the
+	// backend supports one. The returned slice aligns with ids by index.
+	DeleteMany(ids []uint64) []error
+	// ByName returns the group with the given name, or nil if there is none.
+	ByName(name string) (*WpasteGroup, error)
+	// Iterate calls fn for every stored group, stopping early if fn
+	// returns false.
+	Iterate(fn func(*WpasteGroup) bool) error
+}
+
+// store is the backend every handler saves and loads pastes through
+var store Store
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestFSStorePutGetDelete(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wpaste-fsstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFSStore(dir)
+	assert.NoError(t, err)
+
+	w := &WpasteGroup{Name: "test", Data: "hello"}
+	assert.NoError(t, s.Put(w))
+	assert.NotZero(t, w.id)
+
+	got, err := s.Get(w.id)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", got.Name)
+	assert.Equal(t, "hello", got.Data)
+
+	byName, err := s.ByName("test")
+	assert.NoError(t, err)
+	assert.Equal(t, w.id, byName.id)
+
+	assert.NoError(t, s.Delete(w.id))
+
+	got, err = s.Get(w.id)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestFSStoreByNameDoesNotReadOtherBodies(t *testing.T) {
+	dir, err := os.MkdirTemp("", "wpaste-fsstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFSStore(dir)
+	assert.NoError(t, err)
+
+	other := &WpasteGroup{Name: "other", Data: "hello"}
+	assert.NoError(t, s.Put(other))
+	target := &WpasteGroup{Name: "target", Data: "world"}
+	assert.NoError(t, s.Put(target))
+
+	// corrupt the unrelated paste's body; a ByName scan that reads every
+	// body along the way would fail decoding it
+	assert.NoError(t, os.WriteFile(s.bodyPath(other.id), []byte("not gob"), 0600))
+
+	found, err := s.ByName("target")
+	assert.NoError(t, err)
+	assert.Equal(t, target.id, found.id)
+	assert.Equal(t, "world", found.Data)
+}
+
+func TestBoltStoreDeleteMany(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	s, err := NewBoltStore(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	a := &WpasteGroup{Name: "a", Data: "1"}
+	b := &WpasteGroup{Name: "b", Data: "2"}
+	assert.NoError(t, s.Put(a))
+	assert.NoError(t, s.Put(b))
+
+	errs := s.DeleteMany([]uint64{a.id, b.id})
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	gotA, err := s.Get(a.id)
+	assert.NoError(t, err)
+	assert.Nil(t, gotA)
+
+	byName, err := s.ByName("b")
+	assert.NoError(t, err)
+	assert.Nil(t, byName)
+}
+
+func TestBoltStoreNameIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	s, err := NewBoltStore(path)
+	assert.NoError(t, err)
+
+	w := &WpasteGroup{Name: "test", Data: "hello"}
+	assert.NoError(t, s.Put(w))
+
+	byName, err := s.ByName("test")
+	assert.NoError(t, err)
+	assert.Equal(t, w.id, byName.id)
+
+	assert.NoError(t, s.Delete(w.id))
+
+	byName, err = s.ByName("test")
+	assert.NoError(t, err)
+	assert.Nil(t, byName)
+	assert.NoError(t, s.Close())
+}
+
+func TestBoltStoreMigratesNameIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	s, err := NewBoltStore(path)
+	assert.NoError(t, err)
+	w := &WpasteGroup{Name: "legacy", Data: "hello"}
+	assert.NoError(t, s.Put(w))
+
+	// simulate a pre-index database: empty "names" directly via bbolt,
+	// leaving "files" alone, the way a database predating chunk0-5 would
+	// look, then reopen and let NewBoltStore's migration repopulate it
+	assert.NoError(t, s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("names")); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte("names"))
+		return err
+	}))
+	assert.NoError(t, s.Close())
+
+	reopened, err := NewBoltStore(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+
+	byName, err := reopened.ByName("legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, w.id, byName.id)
+}
+
+func TestAPIKeyStoreAddLookupRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.db")
+
+	keys, err := NewAPIKeyStore(path)
+	assert.NoError(t, err)
+	defer keys.Close()
+
+	key, err := keys.Add("ci", 1024, 4096, 10)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, key)
+
+	record, err := keys.Lookup(key)
+	assert.NoError(t, err)
+	assert.NotNil(t, record)
+	assert.Equal(t, "ci", record.Name)
+	assert.Equal(t, int64(1024), record.MaxPasteSize)
+	assert.False(t, record.Revoked)
+
+	assert.NoError(t, keys.AddUsage(record.HashedKey, 100))
+	record, err = keys.Lookup(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), record.BytesUsed)
+
+	assert.NoError(t, keys.Revoke(key))
+	record, err = keys.Lookup(key)
+	assert.NoError(t, err)
+	assert.True(t, record.Revoked)
+}